@@ -0,0 +1,107 @@
+package api
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// parseTrustedProxies turns the configured CIDR strings into net.IPNets,
+// logging and skipping any that fail to parse (e.g. a bare IP missing its
+// /32) so a typo'd TrustedProxies entry doesn't silently fail open.
+func parseTrustedProxies(cidrs []string) []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			logrus.WithField("cidr", cidr).Warn("Ignoring invalid trusted proxy CIDR")
+			continue
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets
+}
+
+func trusted(ip net.IP, proxies []*net.IPNet) bool {
+	for _, proxy := range proxies {
+		if proxy.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the real client address for r, honoring
+// X-Forwarded-For/Forwarded only when the immediate peer is one of the
+// configured trusted proxies. Otherwise it falls back to the host part of
+// r.RemoteAddr, with the port stripped.
+//
+// Edge proxies like Netlify/Cloudflare append the address they observed to
+// whatever X-Forwarded-For they received rather than replacing it, so the
+// real client is the rightmost entry that isn't itself a trusted proxy, not
+// the leftmost entry (which a client can set to anything it likes).
+func clientIP(r *http.Request, trustedProxies []*net.IPNet) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	peer := net.ParseIP(host)
+	if peer == nil || !trusted(peer, trustedProxies) {
+		return host
+	}
+
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		if ip := rightmostUntrusted(strings.Split(xff, ","), trustedProxies); ip != "" {
+			return ip
+		}
+	}
+
+	if fwd := r.Header.Get("Forwarded"); fwd != "" {
+		var fors []string
+		for _, directive := range strings.Split(fwd, ",") {
+			for _, kv := range strings.Split(directive, ";") {
+				pair := strings.SplitN(strings.TrimSpace(kv), "=", 2)
+				if len(pair) == 2 && strings.EqualFold(strings.TrimSpace(pair[0]), "for") {
+					fors = append(fors, strings.Trim(pair[1], `"[]`))
+				}
+			}
+		}
+		if ip := rightmostUntrusted(fors, trustedProxies); ip != "" {
+			return ip
+		}
+	}
+
+	return host
+}
+
+// rightmostUntrusted walks a proxy-appended address chain (oldest/client
+// first, most recent hop last) from the right and returns the IP of the
+// first entry that isn't itself a trusted proxy — i.e. the address the
+// nearest trusted hop actually observed, without any port or brackets.
+// Returns "" if every entry is trusted or fails to parse.
+func rightmostUntrusted(chain []string, trustedProxies []*net.IPNet) string {
+	for i := len(chain) - 1; i >= 0; i-- {
+		candidate := strings.TrimSpace(chain[i])
+		if candidate == "" {
+			continue
+		}
+
+		host := candidate
+		if h, _, err := net.SplitHostPort(candidate); err == nil {
+			host = h
+		}
+		host = strings.Trim(host, "[]")
+
+		ip := net.ParseIP(host)
+		if ip == nil {
+			continue
+		}
+		if !trusted(ip, trustedProxies) {
+			return host
+		}
+	}
+	return ""
+}
@@ -0,0 +1,93 @@
+package api
+
+import (
+	"sync"
+	"time"
+
+	"github.com/netlify/gotell/conf"
+	"golang.org/x/time/rate"
+)
+
+// idleTTL is how long a client key can go unused before its limiter is
+// evicted. Without this, anon/verified would grow one entry per distinct
+// key forever — and a spoofed or rotating client IP can mint a new key on
+// every request.
+const idleTTL = 10 * time.Minute
+
+// sweepInterval is how often evictIdle scans for idle limiters to drop.
+const sweepInterval = time.Minute
+
+// limiterEntry pairs a limiter with the last time it was touched, so
+// evictIdle can tell which entries are safe to drop.
+type limiterEntry struct {
+	limiter  *rate.Limiter
+	lastUsed time.Time
+}
+
+// rateLimiter hands out a token-bucket limiter per client key, with
+// verified-JWT and anonymous clients tracked in separate buckets so a
+// flood of anonymous traffic can't starve known commenters.
+type rateLimiter struct {
+	mutex    sync.Mutex
+	anon     map[string]*limiterEntry
+	verified map[string]*limiterEntry
+	limit    rate.Limit
+	burst    int
+}
+
+func newRateLimiter(config conf.RateLimitConfiguration) *rateLimiter {
+	rl := &rateLimiter{
+		anon:     map[string]*limiterEntry{},
+		verified: map[string]*limiterEntry{},
+		limit:    rate.Limit(config.RatePerMinute / 60),
+		burst:    config.Burst,
+	}
+	go rl.evictIdle()
+	return rl
+}
+
+// enabled reports whether rate limiting is configured at all.
+func (rl *rateLimiter) enabled() bool {
+	return rl.limit > 0
+}
+
+func (rl *rateLimiter) allow(key string, verified bool) bool {
+	bucket := rl.anon
+	if verified {
+		bucket = rl.verified
+	}
+
+	rl.mutex.Lock()
+	entry, ok := bucket[key]
+	if !ok {
+		entry = &limiterEntry{limiter: rate.NewLimiter(rl.limit, rl.burst)}
+		bucket[key] = entry
+	}
+	entry.lastUsed = time.Now()
+	limiter := entry.limiter
+	rl.mutex.Unlock()
+
+	return limiter.Allow()
+}
+
+// evictIdle runs for the life of the rateLimiter, periodically dropping
+// limiters that haven't been used in idleTTL so the maps stay bounded by
+// recently-active clients rather than every key ever seen.
+func (rl *rateLimiter) evictIdle() {
+	for range time.Tick(sweepInterval) {
+		cutoff := time.Now().Add(-idleTTL)
+
+		rl.mutex.Lock()
+		for key, entry := range rl.anon {
+			if entry.lastUsed.Before(cutoff) {
+				delete(rl.anon, key)
+			}
+		}
+		for key, entry := range rl.verified {
+			if entry.lastUsed.Before(cutoff) {
+				delete(rl.verified, key)
+			}
+		}
+		rl.mutex.Unlock()
+	}
+}
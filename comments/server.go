@@ -1,13 +1,17 @@
 package comments
 
 import (
-	"context"
+	"compress/gzip"
 	"fmt"
+	"io"
 	"net/http"
+	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/Sirupsen/logrus"
-	"github.com/guregu/kami"
+	"github.com/go-chi/chi/v5"
 	"github.com/netlify/gotell/conf"
 	"github.com/rs/cors"
 )
@@ -24,20 +28,84 @@ func (s *Server) ListenAndServe() error {
 	return http.ListenAndServe(l, s.handler)
 }
 
-func (s *Server) serveFile(ctx context.Context, w http.ResponseWriter, r *http.Request) {
-	path := ctx.Value("path").(string)
+// serveFile serves pre-built thread JSON. Artifacts are written out
+// pre-gzipped (as "<path>.gz") to save space in the build output, so
+// serving is a three-way negotiation: stream the .gz straight through to
+// clients that accept gzip, decompress on the fly for clients that don't,
+// and fall back to the plain file when no .gz exists.
+func (s *Server) serveFile(w http.ResponseWriter, r *http.Request) {
+	path := chi.URLParam(r, "*")
 
 	fs := filepath.Join(s.config.Threads.Destination, path)
-	http.ServeFile(w, r, fs)
+	gzFs := fs + ".gz"
+
+	gzFile, err := os.Open(gzFs)
+	if err != nil {
+		http.ServeFile(w, r, fs)
+		return
+	}
+	defer gzFile.Close()
+
+	info, err := gzFile.Stat()
+	if err != nil {
+		logrus.Errorf("Error stat'ing %v: %v", gzFs, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	etag := fmt.Sprintf(`W/"%x-%x"`, info.ModTime().UnixNano(), info.Size())
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", info.ModTime().UTC().Format(http.TimeFormat))
+
+	if notModified(r, info.ModTime(), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+		w.Header().Set("Content-Encoding", "gzip")
+		io.Copy(w, gzFile)
+		return
+	}
+
+	reader, err := gzip.NewReader(gzFile)
+	if err != nil {
+		logrus.Errorf("Error decompressing %v: %v", gzFs, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer reader.Close()
+
+	io.Copy(w, reader)
+}
+
+// notModified reports whether r's conditional-GET headers (If-None-Match
+// takes precedence over If-Modified-Since, same as http.ServeContent) show
+// the client's cached copy identified by etag/modTime is still fresh, so
+// serveFile can answer with a 304 instead of re-sending a popular thread's
+// comments on every repeat visit.
+func notModified(r *http.Request, modTime time.Time, etag string) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		return inm == etag || inm == "*"
+	}
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" {
+		if t, err := http.ParseTime(ims); err == nil && !modTime.Truncate(time.Second).After(t) {
+			return true
+		}
+	}
+	return false
 }
 
 func NewServer(config *conf.Configuration) *Server {
+	conf.ConfigureLogging(config)
+
 	s := &Server{
 		config: config,
 	}
 
-	mux := kami.New()
-	mux.Get("/*path", s.serveFile)
+	router := chi.NewRouter()
+	router.Get("/*", s.serveFile)
 
 	corsHandler := cors.New(cors.Options{
 		AllowedMethods:   []string{"GET", "POST", "PATCH", "PUT", "DELETE"},
@@ -46,6 +114,6 @@ func NewServer(config *conf.Configuration) *Server {
 		AllowCredentials: true,
 	})
 
-	s.handler = corsHandler.Handler(mux)
+	s.handler = corsHandler.Handler(router)
 	return s
-}
\ No newline at end of file
+}
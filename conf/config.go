@@ -0,0 +1,82 @@
+package conf
+
+import "time"
+
+// APIConfiguration holds the settings for the comment submission API.
+type APIConfiguration struct {
+	Host       string
+	Port       int
+	Repository string
+
+	// TrustedProxies lists the CIDRs of reverse proxies (Netlify, Cloudflare,
+	// etc.) GoTell runs behind. X-Forwarded-For/Forwarded headers are only
+	// honored when the immediate peer falls in one of these ranges.
+	TrustedProxies []string
+}
+
+// RateLimitConfiguration controls the token-bucket limiter in front of
+// postComment.
+type RateLimitConfiguration struct {
+	// RatePerMinute is the steady-state number of requests/minute allowed
+	// per client. Zero disables rate limiting.
+	RatePerMinute float64
+	Burst         int
+}
+
+// ThreadsConfiguration holds the settings for the static comments file server.
+type ThreadsConfiguration struct {
+	Host        string
+	Port        int
+	Source      string
+	Destination string
+}
+
+// JWTConfiguration holds the settings used to verify commenter identity tokens.
+type JWTConfiguration struct {
+	Secret string
+}
+
+// GitHubConfiguration holds the credentials used when VCS.Backend is "github".
+type GitHubConfiguration struct {
+	AccessToken string
+}
+
+// GitLabConfiguration holds the credentials used when VCS.Backend is "gitlab".
+type GitLabConfiguration struct {
+	AccessToken string
+	BaseURL     string
+}
+
+// VCSConfiguration selects and configures the backend used to open comment
+// proposals (pull requests on GitHub, merge requests on GitLab).
+type VCSConfiguration struct {
+	Backend string // "github" (default) or "gitlab"
+	GitHub  GitHubConfiguration
+	GitLab  GitLabConfiguration
+}
+
+// BatchConfiguration controls batched moderation: grouping pending comments
+// on the same thread onto a single open proposal instead of one per comment.
+type BatchConfiguration struct {
+	// Window is the length of the fixed time buckets (counted from the Unix
+	// epoch) that pending comments are grouped into: when the current bucket
+	// ends, a fresh pending branch and proposal are started. A proposal
+	// opened late in a bucket therefore accepts comments for less than
+	// Window. Zero means batching never expires a proposal on its own.
+	Window time.Duration
+}
+
+// Configuration is the root config object loaded for both the API and
+// comments servers.
+type Configuration struct {
+	API       APIConfiguration
+	Threads   ThreadsConfiguration
+	JWT       JWTConfiguration
+	VCS       VCSConfiguration
+	Batch     BatchConfiguration
+	RateLimit RateLimitConfiguration
+
+	// LogFormat selects the logrus formatter: "json" for line-delimited
+	// JSON (suitable for ELK/Loki), anything else for human-readable text.
+	LogFormat string
+}
@@ -0,0 +1,13 @@
+package conf
+
+import "github.com/Sirupsen/logrus"
+
+// ConfigureLogging sets the global logrus formatter from config.LogFormat.
+// Operators pass --log-format=json to get line-delimited JSON suitable for
+// shipping to ELK/Loki; anything else (including unset) keeps the default
+// human-readable text formatter.
+func ConfigureLogging(config *Configuration) {
+	if config.LogFormat == "json" {
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+	}
+}
@@ -0,0 +1,50 @@
+// Package gotell holds types shared across GoTell's servers, independent of
+// any one HTTP framework.
+package gotell
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Stable API error codes returned to clients. Treat these as part of the
+// public API: add new ones freely, but never repurpose an existing code.
+const (
+	ErrCodeThreadClosed   = "thread_closed"
+	ErrCodeBannedIP       = "banned_ip"
+	ErrCodeBannedEmail    = "banned_email"
+	ErrCodeBannedKeyword  = "banned_keyword"
+	ErrCodeInvalidPayload = "invalid_payload"
+	ErrCodeUpstreamGitHub = "upstream_github"
+	ErrCodeRateLimited    = "rate_limited"
+	ErrCodeInternal       = "internal"
+)
+
+// APIError is the structured error envelope returned by the comment API's
+// endpoints, so clients only ever need one parser. The comments file server
+// answers its errors with plain text instead.
+type APIError struct {
+	Code      string      `json:"code"`
+	Message   string      `json:"message"`
+	Status    int         `json:"-"`
+	Details   interface{} `json:"details,omitempty"`
+	RequestID string      `json:"request_id,omitempty"`
+}
+
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+// NewAPIError builds an APIError for the given stable code, message and
+// HTTP status.
+func NewAPIError(code, message string, status int) *APIError {
+	return &APIError{Code: code, Message: message, Status: status}
+}
+
+// WriteAPIError writes err to w as a JSON APIError envelope, setting the
+// response status code from err.Status.
+func WriteAPIError(w http.ResponseWriter, err *APIError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(err.Status)
+	json.NewEncoder(w).Encode(err)
+}
@@ -0,0 +1,121 @@
+package store
+
+import (
+	"context"
+
+	"github.com/google/go-github/github"
+	"golang.org/x/oauth2"
+)
+
+// GitHubStore implements CommentStore against the GitHub API, opening pull
+// requests for comments that require moderation.
+type GitHubStore struct {
+	client *github.Client
+}
+
+// NewGitHubStore builds a GitHubStore authenticated with accessToken.
+func NewGitHubStore(accessToken string) *GitHubStore {
+	var httpClient = oauth2.NewClient(context.Background(), oauth2.StaticTokenSource(
+		&oauth2.Token{AccessToken: accessToken},
+	))
+	return &GitHubStore{client: github.NewClient(httpClient)}
+}
+
+func (s *GitHubStore) GetDefaultBranch(ctx context.Context, repo Repo) (string, string, error) {
+	ghRepo, _, err := s.client.Repositories.Get(ctx, repo.Owner, repo.Name)
+	if err != nil {
+		return "", "", err
+	}
+	defaultBranch := ghRepo.GetDefaultBranch()
+
+	branch, _, err := s.client.Repositories.GetBranch(ctx, repo.Owner, repo.Name, defaultBranch)
+	if err != nil {
+		return "", "", err
+	}
+	return defaultBranch, branch.Commit.GetSHA(), nil
+}
+
+func (s *GitHubStore) CreateBranch(ctx context.Context, repo Repo, branch, fromSHA string) error {
+	refName := "refs/heads/" + branch
+	_, _, err := s.client.Git.CreateRef(ctx, repo.Owner, repo.Name, &github.Reference{
+		Ref:    &refName,
+		Object: &github.GitObject{SHA: &fromSHA},
+	})
+	return err
+}
+
+func (s *GitHubStore) CommitFile(ctx context.Context, repo Repo, branch, path, message string, content []byte) error {
+	_, _, err := s.client.Repositories.CreateFile(ctx, repo.Owner, repo.Name, path, &github.RepositoryContentFileOptions{
+		Message: &message,
+		Content: content,
+		Branch:  &branch,
+	})
+	return err
+}
+
+func (s *GitHubStore) OpenProposal(ctx context.Context, repo Repo, opts ProposalOptions) (*Proposal, error) {
+	pr := &github.NewPullRequest{
+		Title: &opts.Title,
+		Body:  &opts.Body,
+		Head:  &opts.Head,
+		Base:  &opts.Base,
+		Draft: &opts.Draft,
+	}
+	created, _, err := s.client.PullRequests.Create(ctx, repo.Owner, repo.Name, pr)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(opts.Assignees) > 0 {
+		_, _, err = s.client.Issues.AddAssignees(ctx, repo.Owner, repo.Name, created.GetNumber(), opts.Assignees)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(opts.Labels) > 0 {
+		_, _, err = s.client.Issues.AddLabelsToIssue(ctx, repo.Owner, repo.Name, created.GetNumber(), opts.Labels)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &Proposal{
+		Number:    created.GetNumber(),
+		URL:       created.GetHTMLURL(),
+		Body:      created.GetBody(),
+		CreatedAt: created.GetCreatedAt(),
+	}, nil
+}
+
+// FindProposalForBranch lists open PRs whose head is branch. GitTell only
+// ever opens at most one PR per pending branch, so the first match wins.
+func (s *GitHubStore) FindProposalForBranch(ctx context.Context, repo Repo, branch string) (*Proposal, error) {
+	opts := &github.PullRequestListOptions{
+		State: "open",
+		Head:  repo.Owner + ":" + branch,
+	}
+	prs, _, err := s.client.PullRequests.List(ctx, repo.Owner, repo.Name, opts)
+	if err != nil {
+		return nil, err
+	}
+	if len(prs) == 0 {
+		return nil, nil
+	}
+
+	pr := prs[0]
+	return &Proposal{
+		Number:    pr.GetNumber(),
+		URL:       pr.GetHTMLURL(),
+		Body:      pr.GetBody(),
+		CreatedAt: pr.GetCreatedAt(),
+	}, nil
+}
+
+func (s *GitHubStore) UpdateProposal(ctx context.Context, repo Repo, number int, opts ProposalOptions) error {
+	_, _, err := s.client.PullRequests.Edit(ctx, repo.Owner, repo.Name, number, &github.PullRequest{
+		Title: &opts.Title,
+		Body:  &opts.Body,
+	})
+	return err
+}
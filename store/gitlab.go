@@ -0,0 +1,161 @@
+package store
+
+import (
+	"fmt"
+
+	"github.com/Sirupsen/logrus"
+	gitlab "github.com/xanzy/go-gitlab"
+	"golang.org/x/net/context"
+)
+
+// GitLabStore implements CommentStore against a (self-hosted or gitlab.com)
+// GitLab instance, opening merge requests for comments that require
+// moderation.
+type GitLabStore struct {
+	client *gitlab.Client
+}
+
+// NewGitLabStore builds a GitLabStore for the GitLab instance at baseURL,
+// authenticated with accessToken. baseURL may be empty to use gitlab.com.
+func NewGitLabStore(baseURL, accessToken string) (*GitLabStore, error) {
+	client := gitlab.NewClient(nil, accessToken)
+	if baseURL != "" {
+		if err := client.SetBaseURL(baseURL); err != nil {
+			return nil, err
+		}
+	}
+	return &GitLabStore{client: client}, nil
+}
+
+func projectID(repo Repo) string {
+	return fmt.Sprintf("%v/%v", repo.Owner, repo.Name)
+}
+
+func (s *GitLabStore) GetDefaultBranch(ctx context.Context, repo Repo) (string, string, error) {
+	project, _, err := s.client.Projects.GetProject(projectID(repo), nil, gitlab.WithContext(ctx))
+	if err != nil {
+		return "", "", err
+	}
+	defaultBranch := project.DefaultBranch
+
+	branch, _, err := s.client.Branches.GetBranch(projectID(repo), defaultBranch, gitlab.WithContext(ctx))
+	if err != nil {
+		return "", "", err
+	}
+	return defaultBranch, branch.Commit.ID, nil
+}
+
+func (s *GitLabStore) CreateBranch(ctx context.Context, repo Repo, branch, fromSHA string) error {
+	_, _, err := s.client.Branches.CreateBranch(projectID(repo), &gitlab.CreateBranchOptions{
+		Branch: &branch,
+		Ref:    &fromSHA,
+	}, gitlab.WithContext(ctx))
+	return err
+}
+
+func (s *GitLabStore) CommitFile(ctx context.Context, repo Repo, branch, path, message string, content []byte) error {
+	fileContent := string(content)
+	action := gitlab.FileCreate
+	_, _, err := s.client.Commits.CreateCommit(projectID(repo), &gitlab.CreateCommitOptions{
+		Branch:        &branch,
+		CommitMessage: &message,
+		Actions: []*gitlab.CommitActionOptions{
+			{
+				Action:   &action,
+				FilePath: &path,
+				Content:  &fileContent,
+			},
+		},
+	}, gitlab.WithContext(ctx))
+	return err
+}
+
+func (s *GitLabStore) OpenProposal(ctx context.Context, repo Repo, opts ProposalOptions) (*Proposal, error) {
+	title := opts.Title
+	if opts.Draft {
+		// GitLab has no dedicated "draft" field in older API versions; the
+		// "Draft: " title prefix is what the web UI itself uses to flag a
+		// draft MR, and it's recognized the same way on read.
+		title = "Draft: " + title
+	}
+
+	createOpts := &gitlab.CreateMergeRequestOptions{
+		Title:        &title,
+		Description:  &opts.Body,
+		SourceBranch: &opts.Head,
+		TargetBranch: &opts.Base,
+		Labels:       opts.Labels,
+	}
+
+	if len(opts.Assignees) > 0 {
+		ids, err := s.resolveAssigneeIDs(ctx, opts.Assignees)
+		if err != nil {
+			return nil, err
+		}
+		createOpts.AssigneeIDs = &ids
+	}
+
+	mr, _, err := s.client.MergeRequests.CreateMergeRequest(projectID(repo), createOpts, gitlab.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	return mrToProposal(mr), nil
+}
+
+// mrToProposal converts a go-gitlab MergeRequest to a Proposal, guarding
+// against CreatedAt being nil the way GitHubStore's GetCreatedAt() getter
+// does for its own responses.
+func mrToProposal(mr *gitlab.MergeRequest) *Proposal {
+	proposal := &Proposal{Number: mr.IID, URL: mr.WebURL, Body: mr.Description}
+	if mr.CreatedAt != nil {
+		proposal.CreatedAt = *mr.CreatedAt
+	}
+	return proposal
+}
+
+// resolveAssigneeIDs looks up the numeric user ID GitLab requires for each
+// username in assignees. Unlike GitHub's username-based AddAssignees, the
+// GitLab API only accepts assignee IDs. Usernames that don't resolve to a
+// user are logged and skipped rather than failing the whole proposal.
+func (s *GitLabStore) resolveAssigneeIDs(ctx context.Context, assignees []string) ([]int, error) {
+	ids := make([]int, 0, len(assignees))
+	for _, username := range assignees {
+		users, _, err := s.client.Users.ListUsers(&gitlab.ListUsersOptions{Username: &username}, gitlab.WithContext(ctx))
+		if err != nil {
+			return nil, err
+		}
+		if len(users) == 0 {
+			logrus.Warnf("gitlab: no user found for assignee %q, skipping", username)
+			continue
+		}
+		ids = append(ids, users[0].ID)
+	}
+	return ids, nil
+}
+
+// FindProposalForBranch lists open MRs whose source branch is branch.
+// GoTell only ever opens at most one MR per pending branch, so the first
+// match wins.
+func (s *GitLabStore) FindProposalForBranch(ctx context.Context, repo Repo, branch string) (*Proposal, error) {
+	state := "opened"
+	mrs, _, err := s.client.MergeRequests.ListProjectMergeRequests(projectID(repo), &gitlab.ListProjectMergeRequestsOptions{
+		SourceBranch: &branch,
+		State:        &state,
+	}, gitlab.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if len(mrs) == 0 {
+		return nil, nil
+	}
+
+	return mrToProposal(mrs[0]), nil
+}
+
+func (s *GitLabStore) UpdateProposal(ctx context.Context, repo Repo, number int, opts ProposalOptions) error {
+	_, _, err := s.client.MergeRequests.UpdateMergeRequest(projectID(repo), number, &gitlab.UpdateMergeRequestOptions{
+		Title:       &opts.Title,
+		Description: &opts.Body,
+	}, gitlab.WithContext(ctx))
+	return err
+}
@@ -0,0 +1,85 @@
+// Package store abstracts the VCS operations GoTell needs in order to land
+// a comment as a file and, when moderation is required, propose it for
+// review. CommentStore is implemented once per supported backend (GitHub
+// pull requests, GitLab merge requests) so the rest of GoTell never has to
+// know which one it's talking to.
+package store
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/netlify/gotell/conf"
+)
+
+// PendingLabel marks a proposal as a GoTell batched-moderation PR/MR.
+// FindProposalForBranch does not look at labels; it matches on the head
+// branch alone.
+const PendingLabel = "gotell:pending"
+
+// Repo identifies the repository a store operates against.
+type Repo struct {
+	Owner string
+	Name  string
+}
+
+// ProposalOptions configures how a proposal (pull request / merge request)
+// is opened or updated. Not every backend honors every field.
+type ProposalOptions struct {
+	Title     string
+	Body      string
+	Head      string
+	Base      string
+	Labels    []string
+	Assignees []string
+	Draft     bool
+}
+
+// Proposal is the backend-agnostic result of opening a pull request or
+// merge request.
+type Proposal struct {
+	Number    int
+	URL       string
+	Body      string
+	CreatedAt time.Time
+}
+
+// CommentStore is implemented by each supported VCS backend and covers the
+// operations postComment needs: writing a comment file to a branch and,
+// when moderation is required, proposing that branch for review.
+type CommentStore interface {
+	// GetDefaultBranch returns the name and tip commit SHA of repo's default
+	// branch. Never assume it's "master"/"main" — it's whatever the repo was
+	// actually configured with.
+	GetDefaultBranch(ctx context.Context, repo Repo) (branch string, sha string, err error)
+
+	// CreateBranch creates branch in repo, pointing at fromSHA.
+	CreateBranch(ctx context.Context, repo Repo, branch, fromSHA string) error
+
+	// CommitFile writes content to path on branch with the given commit message.
+	CommitFile(ctx context.Context, repo Repo, branch, path, message string, content []byte) error
+
+	// OpenProposal opens a pull request / merge request for branch against opts.Base.
+	OpenProposal(ctx context.Context, repo Repo, opts ProposalOptions) (*Proposal, error)
+
+	// FindProposalForBranch returns the open proposal whose head is branch,
+	// or nil if there isn't one. Used to batch comments onto an existing PR.
+	FindProposalForBranch(ctx context.Context, repo Repo, branch string) (*Proposal, error)
+
+	// UpdateProposal updates the title/body of an already-open proposal.
+	UpdateProposal(ctx context.Context, repo Repo, number int, opts ProposalOptions) error
+}
+
+// New builds the CommentStore selected by config.VCS.Backend. It defaults
+// to GitHub when Backend is empty, to keep existing configs working.
+func New(config *conf.Configuration) (CommentStore, error) {
+	switch config.VCS.Backend {
+	case "", "github":
+		return NewGitHubStore(config.VCS.GitHub.AccessToken), nil
+	case "gitlab":
+		return NewGitLabStore(config.VCS.GitLab.BaseURL, config.VCS.GitLab.AccessToken)
+	default:
+		return nil, fmt.Errorf("unknown VCS backend: %v", config.VCS.Backend)
+	}
+}